@@ -0,0 +1,154 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/dexidp/dex/server/internal"
+	"github.com/dexidp/dex/storage"
+)
+
+// handleToken is the token endpoint's single entry point, dispatching to
+// the grant-specific handler once the client has been authenticated.
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.tokenErrHelper(w, errInvalidRequest, "Failed to parse request body.", http.StatusBadRequest)
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostFormValue("client_id")
+		clientSecret = r.PostFormValue("client_secret")
+	}
+	client, err := s.storage.GetClient(clientID)
+	if err != nil || client.Secret != clientSecret {
+		s.tokenErrHelper(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.PostFormValue("grant_type") {
+	case grantTypeAuthorizationCode:
+		s.handleAuthCode(w, r, client)
+	case grantTypeRefreshToken:
+		s.handleRefreshToken(w, r, client)
+	default:
+		s.tokenErrHelper(w, errUnsupportedGrantType, "", http.StatusBadRequest)
+	}
+}
+
+// handleAuthCode exchanges an authorization code for access, ID and,
+// if the client asked for the offline_access scope, refresh tokens. This
+// is where a refresh token is first minted, so it's also where
+// request-scoped state that needs to follow the token for its whole
+// life — a DPoP binding, the authentication event's strength, the
+// resource indicators it's allowed to narrow to, its risk signals — gets
+// captured, once, at the source.
+func (s *Server) handleAuthCode(w http.ResponseWriter, r *http.Request, client storage.Client) {
+	code := r.PostFormValue("code")
+	authCode, err := s.storage.GetAuthCode(code)
+	if err != nil || authCode.ClientID != client.ID {
+		s.tokenErrHelper(w, errInvalidGrant, "Invalid or expired code parameter.", http.StatusBadRequest)
+		return
+	}
+	if s.now().After(authCode.Expiry) {
+		s.storage.DeleteAuthCode(code)
+		s.tokenErrHelper(w, errInvalidGrant, "Code expired.", http.StatusBadRequest)
+		return
+	}
+
+	var rawRefreshToken, jkt string
+	if contains(authCode.Scopes, scopeOfflineAccess) {
+		refresh, rerr := s.newRefreshTokenForAuthCode(r, authCode)
+		if rerr != nil {
+			s.refreshTokenErrHelper(w, rerr)
+			return
+		}
+		if err := s.storage.CreateRefresh(*refresh); err != nil {
+			s.logger.Errorf("failed to create refresh token: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		// Every refresh updates this token's entry on the user's offline session.
+		ref := &storage.RefreshTokenRef{ID: refresh.ID, ClientID: refresh.ClientID, CreatedAt: refresh.CreatedAt, LastUsed: refresh.LastUsed}
+		err = s.storage.UpdateOfflineSessions(refresh.Claims.UserID, refresh.ConnectorID, func(old storage.OfflineSessions) (storage.OfflineSessions, error) {
+			old.Refresh[refresh.ClientID] = ref
+			return old, nil
+		})
+		if err == storage.ErrNotFound {
+			err = s.storage.CreateOfflineSessions(storage.OfflineSessions{UserID: refresh.Claims.UserID, ConnID: refresh.ConnectorID, Refresh: map[string]*storage.RefreshTokenRef{refresh.ClientID: ref}})
+		}
+		if err != nil {
+			s.logger.Errorf("failed to update offline session: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		rawRefreshToken, err = internal.Marshal(&internal.RefreshToken{RefreshId: refresh.ID, Token: refresh.Token})
+		if err != nil {
+			s.logger.Errorf("failed to marshal refresh token: %v", err)
+			s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+			return
+		}
+		jkt = refresh.JKT
+	}
+
+	accessToken, err := s.newAccessToken(client.ID, authCode.Claims, authCode.Scopes, authCode.Nonce, authCode.ConnectorID, jkt, nil)
+	if err != nil {
+		s.logger.Errorf("failed to create new access token: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	idToken, expiry, err := s.newIDToken(client.ID, authCode.Claims, authCode.Scopes, authCode.Nonce, accessToken, code, authCode.ConnectorID, authCode.ACR, authCode.AMR, authCode.AuthTime)
+	if err != nil {
+		s.logger.Errorf("failed to create ID token: %v", err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.storage.DeleteAuthCode(code); err != nil {
+		s.logger.Errorf("failed to delete used auth code: %v", err)
+	}
+
+	s.writeAccessToken(w, s.toAccessTokenResponse(idToken, accessToken, rawRefreshToken, expiry))
+}
+
+// newRefreshTokenForAuthCode builds the refresh token minted for a fresh
+// authorization_code exchange. If the client presented a DPoP proof, the
+// token is bound to that proof's key so every later refresh has to prove
+// possession of the same key, per RFC 9449.
+func (s *Server) newRefreshTokenForAuthCode(r *http.Request, authCode storage.AuthCode) (*storage.RefreshToken, *refreshError) {
+	jkt, rerr := s.bindDPoPToRefreshToken(r, s.tokenEndpointURL(r))
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	// Risk signals are best-effort and, unlike the DPoP/step-up/resource
+	// fields above, not authoritative: a changed IP or User-Agent can
+	// just as easily mean a network switch as a stolen token. Only
+	// capture them when the operator has explicitly opted in.
+	var signals RiskSignals
+	if s.refreshTokenPolicy.RiskSignalsEnabled() {
+		signals = s.riskSignalSource.Signals(r)
+	}
+
+	now := s.now()
+	return &storage.RefreshToken{
+		ID:                  storage.NewID(),
+		Token:               storage.NewID(),
+		CreatedAt:           now,
+		LastUsed:            now,
+		Claims:              authCode.Claims,
+		ClientID:            authCode.ClientID,
+		Scopes:              authCode.Scopes,
+		Nonce:               authCode.Nonce,
+		ConnectorID:         authCode.ConnectorID,
+		JKT:                 jkt,
+		ACR:                 authCode.ACR,
+		AMR:                 authCode.AMR,
+		AuthTime:            authCode.AuthTime,
+		Resources:           authCode.Resources,
+		FamilyID:            storage.NewID(),
+		IssuedIP:            signals.IPAddress,
+		IssuedUserAgentHash: signals.UserAgentHash,
+	}, nil
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+)
+
+// dpopProofHeader is the HTTP header a client uses to present a DPoP proof,
+// per RFC 9449 section 4.
+const dpopProofHeader = "DPoP"
+
+// dpopJWTType is the required "typ" JOSE header on a DPoP proof JWT.
+const dpopJWTType = "dpop+jwt"
+
+// dpopIatSkew is the maximum allowed difference between a DPoP proof's
+// "iat" claim and the time dex receives it. A proof first seen at t can
+// carry an "iat" up to t+dpopIatSkew and so stays acceptable until
+// t+2*dpopIatSkew, which is how long its "jti" is remembered.
+const dpopIatSkew = 5 * time.Minute
+
+var dpopSignatureAlgs = []jose.SignatureAlgorithm{
+	jose.RS256, jose.PS256, jose.ES256, jose.ES384, jose.ES512,
+}
+
+// dpopProofClaims are the claims carried by a DPoP proof JWT, per RFC 9449
+// section 4.2.
+type dpopProofClaims struct {
+	JTI string `json:"jti"`
+	HTM string `json:"htm"`
+	HTU string `json:"htu"`
+	IAT int64  `json:"iat"`
+}
+
+// dpopReplayCache remembers proof "jti" values that have already been
+// redeemed, so a captured proof can't be replayed while its "iat" is still
+// within the allowed skew.
+//
+// TODO(dex): this is process-local. A dex deployment with multiple
+// replicas behind a load balancer needs this backed by shared storage
+// (e.g. the configured storage.Storage) to close the replay window
+// across instances.
+type dpopReplayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+var defaultDPoPReplayCache = &dpopReplayCache{seen: make(map[string]time.Time)}
+
+// claim records jti as redeemed at now, returning false if it was already
+// claimed within the last 2*dpopIatSkew.
+func (c *dpopReplayCache) claim(jti string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, seenAt := range c.seen {
+		if now.Sub(seenAt) > 2*dpopIatSkew {
+			delete(c.seen, id)
+		}
+	}
+
+	if _, ok := c.seen[jti]; ok {
+		return false
+	}
+	c.seen[jti] = now
+	return true
+}
+
+// verifyDPoPProof validates the DPoP proof attached to r against the
+// expected HTTP method and URL, and returns the base64url-encoded SHA-256
+// JWK thumbprint ("jkt") of the key that produced it.
+func (s *Server) verifyDPoPProof(r *http.Request, htu string) (string, *refreshError) {
+	proof := r.Header.Get(dpopProofHeader)
+	if proof == "" {
+		return "", newBadRequestError("No DPoP proof was found in the request.")
+	}
+
+	jws, err := jose.ParseSigned(proof, dpopSignatureAlgs)
+	if err != nil || len(jws.Signatures) != 1 {
+		return "", newBadRequestError("Malformed DPoP proof.")
+	}
+
+	header := jws.Signatures[0].Header
+	if header.ExtraHeaders[jose.HeaderKey("typ")] != dpopJWTType {
+		return "", newBadRequestError(`DPoP proof is missing the "dpop+jwt" typ header.`)
+	}
+
+	jwk := header.JSONWebKey
+	if jwk == nil || !jwk.Valid() || !jwk.IsPublic() {
+		return "", newBadRequestError("DPoP proof is missing an embedded public JWK.")
+	}
+
+	payload, err := jws.Verify(jwk)
+	if err != nil {
+		return "", newBadRequestError("DPoP proof signature is invalid.")
+	}
+
+	var claims dpopProofClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", newBadRequestError("Malformed DPoP proof claims.")
+	}
+
+	if claims.HTM != http.MethodPost {
+		return "", newBadRequestError(`DPoP proof "htm" does not match the request method.`)
+	}
+	if !dpopHTUMatches(claims.HTU, htu) {
+		return "", newBadRequestError(`DPoP proof "htu" does not match the token endpoint.`)
+	}
+
+	now := s.now()
+	iat := time.Unix(claims.IAT, 0)
+	if iat.After(now.Add(dpopIatSkew)) || iat.Before(now.Add(-dpopIatSkew)) {
+		return "", newBadRequestError(`DPoP proof "iat" is outside the allowed clock skew.`)
+	}
+	if claims.JTI == "" || !defaultDPoPReplayCache.claim(claims.JTI, now) {
+		return "", newBadRequestError("DPoP proof has already been used.")
+	}
+
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return "", newInternalServerError()
+	}
+
+	return base64.RawURLEncoding.EncodeToString(thumbprint), nil
+}
+
+// dpopHTUMatches compares a claimed "htu" against the expected token
+// endpoint URL, ignoring query and fragment per RFC 9449 section 4.3.
+func dpopHTUMatches(claimed, want string) bool {
+	cu, err := url.Parse(claimed)
+	if err != nil {
+		return false
+	}
+	wu, err := url.Parse(want)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(cu.Scheme, wu.Scheme) && strings.EqualFold(cu.Host, wu.Host) && cu.Path == wu.Path
+}
+
+// bindDPoPToRefreshToken is called when a refresh token is first minted
+// (from the authorization_code token issuance path) to
+// record the JWK thumbprint of the DPoP key it should be bound to, if the
+// client presented a DPoP proof. A token with no DPoP proof is left
+// unbound and continues to behave as a bearer token.
+func (s *Server) bindDPoPToRefreshToken(r *http.Request, tokenEndpoint string) (string, *refreshError) {
+	if r.Header.Get(dpopProofHeader) == "" {
+		return "", nil
+	}
+	return s.verifyDPoPProof(r, tokenEndpoint)
+}
+
+// tokenEndpointURL reconstructs the token endpoint URL as the client
+// would have addressed it, for comparison against a DPoP proof's "htu".
+func (s *Server) tokenEndpointURL(r *http.Request) string {
+	scheme := "https"
+	if r.TLS == nil && r.Header.Get("X-Forwarded-Proto") != "https" {
+		scheme = "http"
+	}
+	return scheme + "://" + r.Host + r.URL.Path
+}
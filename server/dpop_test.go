@@ -0,0 +1,279 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/server/internal"
+	"github.com/dexidp/dex/storage"
+	"github.com/dexidp/dex/storage/memory"
+)
+
+// testServerOptions configures the RefreshTokenPolicy and optional
+// extension points a test server is built with. The zero value builds a
+// server with rotation, step-up and risk signals all disabled, matching
+// NewRefreshTokenPolicy's own zero-value defaults.
+type testServerOptions struct {
+	rotation           bool
+	reuseInterval      string
+	allowStepUpRefresh bool
+	enableRiskSignals  bool
+
+	revocationHooks      []RevocationHook
+	revocationHookConfig RevocationHookConfig
+	scopeDownscoper      ScopeDownscoper
+	riskSignalSource     RiskSignalSource
+}
+
+func newTestServer(t *testing.T, opts testServerOptions) (*Server, *memory.Storage) {
+	t.Helper()
+
+	store := memory.New()
+	if err := store.CreateClient(storage.Client{ID: "test-client", Secret: "test-secret"}); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	policy, err := NewRefreshTokenPolicy(logrus.New(), opts.rotation, "", "", opts.reuseInterval, opts.allowStepUpRefresh, opts.enableRiskSignals)
+	if err != nil {
+		t.Fatalf("new refresh token policy: %v", err)
+	}
+
+	s, err := NewServer(Config{
+		Issuer:               "https://dex.example.com",
+		Storage:              store,
+		Logger:               logrus.New(),
+		RefreshTokenPolicy:   policy,
+		RevocationHooks:      opts.revocationHooks,
+		RevocationHookConfig: opts.revocationHookConfig,
+		ScopeDownscoper:      opts.scopeDownscoper,
+		RiskSignalSource:     opts.riskSignalSource,
+	})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	return s, store
+}
+
+func newAuthCode(t *testing.T, store *memory.Storage, scopes []string) string {
+	t.Helper()
+
+	code := storage.AuthCode{
+		ID:          storage.NewID(),
+		ClientID:    "test-client",
+		Scopes:      scopes,
+		ConnectorID: "mock",
+		Claims:      storage.Claims{UserID: "user-1", Email: "user@example.com"},
+		Expiry:      time.Now().Add(time.Minute),
+	}
+	if err := store.CreateAuthCode(code); err != nil {
+		t.Fatalf("create auth code: %v", err)
+	}
+	return code.ID
+}
+
+// authCodeOptions customizes the fields threaded through the authorization
+// code issueRefreshToken exchanges, beyond the default openid/offline_access
+// scopes issued to user-1.
+type authCodeOptions struct {
+	scopes    []string
+	resources []string
+	acr       string
+	amr       []string
+	authTime  time.Time
+	headers   map[string]string
+}
+
+// issueRefreshToken runs a full authorization_code exchange against s using
+// the fields in opts and returns the raw refresh token and its storage ID.
+func issueRefreshToken(t *testing.T, s *Server, store *memory.Storage, opts authCodeOptions) (rawRefreshToken, refreshID string) {
+	t.Helper()
+
+	scopes := opts.scopes
+	if scopes == nil {
+		scopes = []string{"openid", scopeOfflineAccess}
+	}
+	code := storage.AuthCode{
+		ID:          storage.NewID(),
+		ClientID:    "test-client",
+		Scopes:      scopes,
+		ConnectorID: "mock",
+		Claims:      storage.Claims{UserID: "user-1"},
+		Resources:   opts.resources,
+		ACR:         opts.acr,
+		AMR:         opts.amr,
+		AuthTime:    opts.authTime,
+		Expiry:      time.Now().Add(time.Minute),
+	}
+	if err := store.CreateAuthCode(code); err != nil {
+		t.Fatalf("create auth code: %v", err)
+	}
+
+	form := url.Values{"grant_type": {grantTypeAuthorizationCode}, "code": {code.ID}}
+	req := httptest.NewRequest(http.MethodPost, "https://dex.example.com/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range opts.headers {
+		req.Header.Set(k, v)
+	}
+	req.SetBasicAuth("test-client", "test-secret")
+
+	rec := httptest.NewRecorder()
+	s.handleToken(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("token exchange failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var resp accessTokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode token response: %v", err)
+	}
+	if resp.RefreshToken == "" {
+		t.Fatal("expected a refresh token to be issued")
+	}
+
+	token := new(internal.RefreshToken)
+	if err := internal.Unmarshal(resp.RefreshToken, token); err != nil {
+		t.Fatalf("unmarshal refresh token: %v", err)
+	}
+	return resp.RefreshToken, token.RefreshId
+}
+
+// newDPoPKey generates a fresh EC key for signing DPoP proofs.
+func newDPoPKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	return key
+}
+
+// dpopProof builds a DPoP proof JWT for htm/htu signed with key, returning
+// the proof and the key's JWK thumbprint.
+func dpopProof(t *testing.T, key *ecdsa.PrivateKey, htm, htu, jti string, iat time.Time) (proof, thumbprint string) {
+	t.Helper()
+
+	jwk := jose.JSONWebKey{Key: key, Algorithm: "ES256", Use: "sig"}
+
+	opts := (&jose.SignerOptions{EmbedJWK: true}).WithType(dpopJWTType)
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jwk}, opts)
+	if err != nil {
+		t.Fatalf("new signer: %v", err)
+	}
+
+	claims := dpopProofClaims{JTI: jti, HTM: htm, HTU: htu, IAT: iat.Unix()}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatalf("sign proof: %v", err)
+	}
+	compact, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatalf("serialize proof: %v", err)
+	}
+
+	thumb, err := jwk.Public().Thumbprint(crypto.SHA256)
+	if err != nil {
+		t.Fatalf("thumbprint: %v", err)
+	}
+	return compact, base64.RawURLEncoding.EncodeToString(thumb)
+}
+
+func TestDPoPBoundRefreshRequiresMatchingProof(t *testing.T) {
+	s, store := newTestServer(t, testServerOptions{rotation: true})
+
+	codeID := newAuthCode(t, store, []string{"openid", scopeOfflineAccess})
+
+	tokenURL := "https://dex.example.com/token"
+	boundKey := newDPoPKey(t)
+	proof, jkt := dpopProof(t, boundKey, http.MethodPost, tokenURL, "jti-1", s.now())
+
+	form := url.Values{
+		"grant_type": {grantTypeAuthorizationCode},
+		"code":       {codeID},
+	}
+	req := httptest.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("DPoP", proof)
+	req.SetBasicAuth("test-client", "test-secret")
+
+	rec := httptest.NewRecorder()
+	s.handleToken(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("token exchange failed: %d %s", rec.Code, rec.Body.String())
+	}
+
+	var resp accessTokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.RefreshToken == "" {
+		t.Fatal("expected a refresh token to be issued")
+	}
+
+	var claims accessTokenClaims
+	if err := decodeJWTPayload(resp.AccessToken, &claims); err != nil {
+		t.Fatalf("decode access token: %v", err)
+	}
+	if claims.Confirmation == nil || claims.Confirmation.JKT != jkt {
+		t.Fatalf("access token cnf.jkt = %+v, want %s", claims.Confirmation, jkt)
+	}
+
+	refreshWithProof := func(refreshToken, proof string) *httptest.ResponseRecorder {
+		form := url.Values{
+			"grant_type":    {grantTypeRefreshToken},
+			"refresh_token": {refreshToken},
+		}
+		req := httptest.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if proof != "" {
+			req.Header.Set("DPoP", proof)
+		}
+		req.SetBasicAuth("test-client", "test-secret")
+		rec := httptest.NewRecorder()
+		s.handleToken(rec, req)
+		return rec
+	}
+
+	if rec := refreshWithProof(resp.RefreshToken, ""); rec.Code == http.StatusOK {
+		t.Fatal("refresh without a DPoP proof should be rejected for a DPoP-bound token")
+	}
+
+	otherProof, _ := dpopProof(t, newDPoPKey(t), http.MethodPost, tokenURL, "jti-2", s.now())
+	if rec := refreshWithProof(resp.RefreshToken, otherProof); rec.Code == http.StatusOK {
+		t.Fatal("refresh with a different DPoP key should be rejected")
+	}
+
+	matchingProof, _ := dpopProof(t, boundKey, http.MethodPost, tokenURL, "jti-3", s.now())
+	rec = refreshWithProof(resp.RefreshToken, matchingProof)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh with the bound DPoP key should succeed, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	// Replay the proof alongside the current (rotated) refresh token, so the
+	// only thing wrong with the request is the already-used jti.
+	var refreshed accessTokenResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &refreshed); err != nil {
+		t.Fatalf("decode refresh response: %v", err)
+	}
+	if rec := refreshWithProof(refreshed.RefreshToken, matchingProof); rec.Code == http.StatusOK {
+		t.Fatal("replaying the same DPoP proof jti should be rejected")
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// highRiskThreshold is the risk score, per riskScore, at which dex treats
+// a refresh as anomalous enough to preemptively revoke the whole token
+// family rather than waiting for outright reuse to be detected.
+const highRiskThreshold = 2
+
+// FamilyStore is implemented by a storage.Storage that can look up every
+// refresh token descended from the same original issuance. It's a
+// separate, optional interface (rather than a new storage.Storage method)
+// so that backends which don't support the lookup efficiently can leave
+// it unimplemented and fall back to single-token revocation.
+type FamilyStore interface {
+	// ListFamily returns the IDs of every refresh token sharing familyID.
+	ListFamily(familyID string) ([]string, error)
+}
+
+// RiskSignals are optional, best-effort values captured at issuance and
+// compared against the current request at refresh time. None of them are
+// authoritative alone; they only ever raise a risk score, never lower
+// one, and a mismatch never fails a refresh by itself.
+type RiskSignals struct {
+	IPAddress     string
+	UserAgentHash string
+}
+
+// riskScore counts how many of the captured signals differ between
+// issuance and the current request.
+func riskScore(issued, observed RiskSignals) int {
+	score := 0
+	if issued.IPAddress != "" && issued.IPAddress != observed.IPAddress {
+		score++
+	}
+	if issued.UserAgentHash != "" && issued.UserAgentHash != observed.UserAgentHash {
+		score++
+	}
+	return score
+}
+
+// RiskSignalSource lets an operator customize how dex derives the signals
+// it captures at issuance and compares on every refresh. Only the two
+// fields of RiskSignals, an IP address and a User-Agent hash, are stored
+// and compared; there is no slot for further signals such as an ASN.
+// Server falls back to defaultRiskSignalSource when none is configured.
+type RiskSignalSource interface {
+	Signals(r *http.Request) RiskSignals
+}
+
+// defaultRiskSignalSource captures the IP address and a hash of the
+// User-Agent header, dex's signals prior to RiskSignalSource existing.
+type defaultRiskSignalSource struct{}
+
+func (defaultRiskSignalSource) Signals(r *http.Request) RiskSignals {
+	return RiskSignals{
+		IPAddress:     remoteIP(r),
+		UserAgentHash: hashUserAgent(r.UserAgent()),
+	}
+}
+
+// remoteIP returns the client's address, preferring the X-Forwarded-For
+// header over r.RemoteAddr. Behind the load balancer or ingress dex is
+// almost always deployed behind, RemoteAddr is just the proxy's own
+// address, which is constant for every request and useless as a risk
+// signal.
+func remoteIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		if addr := strings.TrimSpace(strings.Split(forwarded, ",")[0]); addr != "" {
+			return addr
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func hashUserAgent(ua string) string {
+	if ua == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(ua))
+	return hex.EncodeToString(sum[:])
+}
+
+// invalidateRefreshTokenFamily revokes every refresh token descended from
+// the same original issuance as refresh, and tears down the associated
+// offline session. It's called both when reuse of an already-rotated
+// token is detected (the strongest signal dex has that a token was
+// stolen) and when a refresh's risk signals look anomalous enough to act
+// on preemptively.
+func (s *Server) invalidateRefreshTokenFamily(refresh *storage.RefreshToken) {
+	ids := []string{refresh.ID}
+
+	if refresh.FamilyID != "" {
+		if familyStore, ok := s.storage.(FamilyStore); ok {
+			familyIDs, err := familyStore.ListFamily(refresh.FamilyID)
+			if err != nil {
+				s.logger.Errorf("failed to list refresh token family %s: %v", refresh.FamilyID, err)
+			} else {
+				ids = familyIDs
+			}
+		}
+	}
+
+	for _, id := range ids {
+		if err := s.storage.DeleteRefresh(id); err != nil && err != storage.ErrNotFound {
+			s.logger.Errorf("failed to delete refresh token %s from family %s: %v", id, refresh.FamilyID, err)
+		}
+	}
+
+	if err := s.storage.DeleteOfflineSessions(refresh.Claims.UserID, refresh.ConnectorID); err != nil && err != storage.ErrNotFound {
+		s.logger.Errorf("failed to delete offline session for %s during family revocation: %v", refresh.Claims.UserID, err)
+	}
+
+	s.logger.Errorf("revoked refresh token family %s for client %s, user %s (%d token(s))", refresh.FamilyID, refresh.ClientID, refresh.Claims.UserID, len(ids))
+
+	s.notifyRevocationHooks(RevocationEvent{
+		ClientID:  refresh.ClientID,
+		RefreshID: refresh.ID,
+		UserID:    refresh.Claims.UserID,
+		Reason:    RevocationReasonRevoked,
+		At:        s.now(),
+	})
+}
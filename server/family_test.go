@@ -0,0 +1,132 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/storage"
+	"github.com/dexidp/dex/storage/memory"
+)
+
+func TestRemoteIPPrefersForwardedFor(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "https://dex.example.com/token", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.1")
+
+	if got, want := remoteIP(req), "203.0.113.7"; got != want {
+		t.Fatalf("remoteIP() = %q, want %q", got, want)
+	}
+}
+
+func TestRemoteIPFallsBackToRemoteAddr(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "https://dex.example.com/token", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+
+	if got, want := remoteIP(req), "10.0.0.1"; got != want {
+		t.Fatalf("remoteIP() = %q, want %q", got, want)
+	}
+}
+
+func TestInvalidateRefreshTokenFamilyDeletesEveryTokenInFamily(t *testing.T) {
+	store := memory.New()
+	s, err := NewServer(Config{Issuer: "https://dex.example.com", Storage: store, Logger: logrus.New()})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	const familyID = "family-1"
+	for _, id := range []string{"refresh-a", "refresh-b"} {
+		if err := store.CreateRefresh(storage.RefreshToken{
+			ID:       id,
+			ClientID: "test-client",
+			Claims:   storage.Claims{UserID: "user-1"},
+			FamilyID: familyID,
+		}); err != nil {
+			t.Fatalf("create refresh %s: %v", id, err)
+		}
+	}
+
+	first, err := store.GetRefresh("refresh-a")
+	if err != nil {
+		t.Fatalf("get refresh-a: %v", err)
+	}
+	s.invalidateRefreshTokenFamily(&first)
+
+	for _, id := range []string{"refresh-a", "refresh-b"} {
+		if _, err := store.GetRefresh(id); err != storage.ErrNotFound {
+			t.Fatalf("refresh %s should have been deleted as part of its family, got err = %v", id, err)
+		}
+	}
+}
+
+func TestInvalidateRefreshTokenFamilyFallsBackToSingleTokenWithoutFamilyID(t *testing.T) {
+	store := memory.New()
+	s, err := NewServer(Config{Issuer: "https://dex.example.com", Storage: store, Logger: logrus.New()})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	if err := store.CreateRefresh(storage.RefreshToken{
+		ID:       "refresh-a",
+		ClientID: "test-client",
+		Claims:   storage.Claims{UserID: "user-1"},
+	}); err != nil {
+		t.Fatalf("create refresh: %v", err)
+	}
+
+	refresh, err := store.GetRefresh("refresh-a")
+	if err != nil {
+		t.Fatalf("get refresh: %v", err)
+	}
+	s.invalidateRefreshTokenFamily(&refresh)
+
+	if _, err := store.GetRefresh("refresh-a"); err != storage.ErrNotFound {
+		t.Fatalf("refresh-a should have been deleted, got err = %v", err)
+	}
+}
+
+func TestRiskSignalsPersistedAtIssuance(t *testing.T) {
+	s, store := newTestServer(t, testServerOptions{enableRiskSignals: true})
+
+	_, refreshID := issueRefreshToken(t, s, store, authCodeOptions{headers: map[string]string{
+		"User-Agent":      "test-agent/1.0",
+		"X-Forwarded-For": "203.0.113.7",
+	}})
+
+	refresh, err := store.GetRefresh(refreshID)
+	if err != nil {
+		t.Fatalf("get refresh: %v", err)
+	}
+	if refresh.IssuedIP != "203.0.113.7" {
+		t.Fatalf("refresh.IssuedIP = %q, want %q", refresh.IssuedIP, "203.0.113.7")
+	}
+	if refresh.IssuedUserAgentHash == "" {
+		t.Fatal("expected a user agent hash to be captured at issuance")
+	}
+	if refresh.FamilyID == "" {
+		t.Fatal("expected a FamilyID to be assigned at issuance")
+	}
+}
+
+func TestRiskSignalsNotCapturedUnlessEnabled(t *testing.T) {
+	// Risk signals default to disabled: testServerOptions{} leaves
+	// enableRiskSignals false.
+	s, store := newTestServer(t, testServerOptions{})
+
+	_, refreshID := issueRefreshToken(t, s, store, authCodeOptions{headers: map[string]string{
+		"User-Agent":      "test-agent/1.0",
+		"X-Forwarded-For": "203.0.113.7",
+	}})
+
+	refresh, err := store.GetRefresh(refreshID)
+	if err != nil {
+		t.Fatalf("get refresh: %v", err)
+	}
+	if refresh.IssuedIP != "" || refresh.IssuedUserAgentHash != "" {
+		t.Fatalf("risk signals should not be captured without opting in, got IssuedIP=%q IssuedUserAgentHash=%q", refresh.IssuedIP, refresh.IssuedUserAgentHash)
+	}
+}
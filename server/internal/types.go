@@ -0,0 +1,35 @@
+// Package internal holds types shared by the server package that are not
+// meant to be part of dex's public API.
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+// RefreshToken is the format handed back to clients as the OAuth2
+// "refresh_token" value. It intentionally carries very little information:
+// just enough to look the real storage.RefreshToken up and confirm the
+// caller holds the current, un-rotated token.
+type RefreshToken struct {
+	RefreshId string `json:"id"`
+	Token     string `json:"t"`
+}
+
+// Marshal encodes a refresh token for use as an OAuth2 token value.
+func Marshal(token *RefreshToken) (string, error) {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Unmarshal decodes a refresh token previously produced by Marshal.
+func Unmarshal(s string, token *RefreshToken) error {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, token)
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v4"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// OAuth2/OIDC error codes used in token endpoint responses.
+const (
+	errInvalidRequest       = "invalid_request"
+	errUnsupportedGrantType = "unsupported_grant_type"
+	errInvalidGrant         = "invalid_grant"
+	errInvalidClient        = "invalid_client"
+	errInvalidScope         = "invalid_scope"
+	errServerError          = "server_error"
+)
+
+const (
+	grantTypeAuthorizationCode = "authorization_code"
+	grantTypeRefreshToken      = "refresh_token"
+
+	// scopeOfflineAccess is the scope a client requests to receive a
+	// refresh token alongside its access and ID tokens.
+	scopeOfflineAccess = "offline_access"
+)
+
+// tokenErrHelper writes an OAuth2 token endpoint error response.
+func (s *Server) tokenErrHelper(w http.ResponseWriter, typ, description string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description,omitempty"`
+	}{typ, description})
+}
+
+// accessTokenResponse is the token endpoint's success response, per
+// https://tools.ietf.org/html/rfc6749#section-5.1.
+type accessTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	IDToken      string `json:"id_token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+func (s *Server) toAccessTokenResponse(idToken, accessToken, refreshToken string, expiry time.Time) *accessTokenResponse {
+	return &accessTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "bearer",
+		IDToken:      idToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(time.Until(expiry).Seconds()),
+	}
+}
+
+func (s *Server) writeAccessToken(w http.ResponseWriter, resp *accessTokenResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// accessTokenClaims are the claims signed into every access token dex
+// mints.
+type accessTokenClaims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience []string `json:"aud,omitempty"`
+	Expiry   int64    `json:"exp"`
+	IssuedAt int64    `json:"iat"`
+
+	ClientID string   `json:"client_id"`
+	Scopes   []string `json:"scope,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+
+	// Confirmation binds this access token to the DPoP key of the
+	// refresh token it was minted from, per RFC 9449 section 5.
+	Confirmation *cnfClaim `json:"cnf,omitempty"`
+}
+
+// cnfClaim is the "cnf" confirmation claim of RFC 7800 / RFC 9449.
+type cnfClaim struct {
+	JKT string `json:"jkt"`
+}
+
+// idTokenClaims are the claims signed into every ID token dex mints.
+type idTokenClaims struct {
+	Issuer   string `json:"iss"`
+	Subject  string `json:"sub"`
+	Audience string `json:"aud"`
+	Expiry   int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+
+	Nonce string `json:"nonce,omitempty"`
+
+	Email             string   `json:"email,omitempty"`
+	EmailVerified     bool     `json:"email_verified,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+
+	// ACR, AMR and AuthTime report the strength of the authentication
+	// event this ID token (and the refresh token it descends from) was
+	// originally backed by.
+	ACR      string   `json:"acr,omitempty"`
+	AMR      []string `json:"amr,omitempty"`
+	AuthTime int64    `json:"auth_time,omitempty"`
+}
+
+// signJWT signs claims with the server's signing key and returns the
+// compact serialization.
+func (s *Server) signJWT(claims interface{}) (string, error) {
+	key := jose.SigningKey{Algorithm: jose.HS256, Key: s.signingKey}
+	signer, err := jose.NewSigner(key, nil)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+	return jws.CompactSerialize()
+}
+
+// decodeJWTPayload base64-decodes a compact JWS's payload without
+// verifying its signature. Used by tests that only need to inspect
+// claims dex itself just minted.
+func decodeJWTPayload(token string, v interface{}) error {
+	jws, err := jose.ParseSigned(token, []jose.SignatureAlgorithm{jose.HS256})
+	if err != nil {
+		return err
+	}
+	payload := jws.UnsafePayloadWithoutVerification()
+	return json.Unmarshal(payload, v)
+}
+
+// newAccessToken mints a signed access token. audience, if non-empty,
+// restricts "aud" to those RFC 8707 resource indicators instead of the
+// requesting client. jkt, if non-empty, binds the token to a DPoP key via
+// a "cnf" claim.
+func (s *Server) newAccessToken(clientID string, claims storage.Claims, scopes []string, nonce, connID, jkt string, audience []string) (string, error) {
+	aud := audience
+	if len(aud) == 0 {
+		aud = []string{clientID}
+	}
+
+	now := s.now()
+	tok := accessTokenClaims{
+		Issuer:   s.issuerURL,
+		Subject:  claims.UserID,
+		Audience: aud,
+		Expiry:   now.Add(accessTokenLifetime).Unix(),
+		IssuedAt: now.Unix(),
+		ClientID: clientID,
+		Scopes:   scopes,
+		Groups:   claims.Groups,
+	}
+	if jkt != "" {
+		tok.Confirmation = &cnfClaim{JKT: jkt}
+	}
+
+	return s.signJWT(tok)
+}
+
+// newIDToken mints a signed ID token carrying the authentication event
+// strength (acr/amr/auth_time) the underlying refresh token (if any) was
+// issued under.
+func (s *Server) newIDToken(clientID string, claims storage.Claims, scopes []string, nonce, accessToken, code, connID string, acr string, amr []string, authTime time.Time) (string, time.Time, error) {
+	now := s.now()
+	expiry := now.Add(idTokenLifetime)
+
+	tok := idTokenClaims{
+		Issuer:            s.issuerURL,
+		Subject:           claims.UserID,
+		Audience:          clientID,
+		Expiry:            expiry.Unix(),
+		IssuedAt:          now.Unix(),
+		Nonce:             nonce,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		PreferredUsername: claims.PreferredUsername,
+		Groups:            claims.Groups,
+		ACR:               acr,
+		AMR:               amr,
+	}
+	if !authTime.IsZero() {
+		tok.AuthTime = authTime.Unix()
+	}
+
+	signed, err := s.signJWT(tok)
+	return signed, expiry, err
+}
@@ -61,7 +61,7 @@ func (s *Server) extractRefreshTokenFromRequest(r *http.Request) (*internal.Refr
 }
 
 // getRefreshTokenFromStorage checks that refresh token is valid and exists in the storage and gets its info
-func (s *Server) getRefreshTokenFromStorage(clientID string, token *internal.RefreshToken) (*storage.RefreshToken, *refreshError) {
+func (s *Server) getRefreshTokenFromStorage(r *http.Request, clientID string, token *internal.RefreshToken) (*storage.RefreshToken, *refreshError) {
 	invalidErr := newBadRequestError(fmt.Sprintf("clientID %s refresh token (ID %s) is invalid or has already been claimed by another client.", clientID, token.RefreshId))
 
 	refresh, err := s.storage.GetRefresh(token.RefreshId)
@@ -88,7 +88,23 @@ func (s *Server) getRefreshTokenFromStorage(clientID string, token *internal.Ref
 		case refresh.ObsoleteToken != token.Token:
 			fallthrough
 		case refresh.ObsoleteToken == "":
+			// An already-rotated (obsolete) token being presented again is
+			// the clearest signal dex has that a refresh token was stolen:
+			// a legitimate client would only ever hold the latest value.
+			// Treat it as compromise of the whole token family, not just
+			// this one token.
 			s.logger.Errorf("refresh token with id %s claimed twice", refresh.ID)
+			s.invalidateRefreshTokenFamily(&refresh)
+			return nil, invalidErr
+		}
+	}
+
+	if s.refreshTokenPolicy.RiskSignalsEnabled() && (refresh.IssuedIP != "" || refresh.IssuedUserAgentHash != "") {
+		observed := s.riskSignalSource.Signals(r)
+		issued := RiskSignals{IPAddress: refresh.IssuedIP, UserAgentHash: refresh.IssuedUserAgentHash}
+		if riskScore(issued, observed) >= highRiskThreshold {
+			s.logger.Errorf("refresh token with id %s used with anomalous signals, revoking its family as a precaution", refresh.ID)
+			s.invalidateRefreshTokenFamily(&refresh)
 			return nil, invalidErr
 		}
 	}
@@ -218,7 +234,7 @@ func (s *Server) updateOfflineSession(refresh *storage.RefreshToken, ident conne
 }
 
 // updateRefreshToken updates refresh token and offline session in the storage
-func (s *Server) updateRefreshToken(token *internal.RefreshToken, refresh *storage.RefreshToken, ident connector.Identity) (*internal.RefreshToken, *refreshError) {
+func (s *Server) updateRefreshToken(token *internal.RefreshToken, refresh *storage.RefreshToken, ident connector.Identity, resources []string) (*internal.RefreshToken, *refreshError) {
 	newToken := token
 	if s.refreshTokenPolicy.RotationEnabled() {
 		newToken = &internal.RefreshToken{
@@ -228,6 +244,7 @@ func (s *Server) updateRefreshToken(token *internal.RefreshToken, refresh *stora
 	}
 
 	lastUsed := s.now()
+	rotated := false
 
 	refreshTokenUpdater := func(old storage.RefreshToken) (storage.RefreshToken, error) {
 		if s.refreshTokenPolicy.RotationEnabled() {
@@ -242,6 +259,7 @@ func (s *Server) updateRefreshToken(token *internal.RefreshToken, refresh *stora
 			}
 
 			old.ObsoleteToken = old.Token
+			rotated = true
 		}
 
 		old.Token = newToken.Token
@@ -255,6 +273,10 @@ func (s *Server) updateRefreshToken(token *internal.RefreshToken, refresh *stora
 		old.Claims.Groups = ident.Groups
 		old.LastUsed = lastUsed
 
+		// Recorded purely for audit: which resource indicators (RFC 8707)
+		// this refresh actually minted an access token for.
+		old.LastIssuedResources = resources
+
 		// ConnectorData has been moved to OfflineSession
 		old.ConnectorData = []byte{}
 		return old, nil
@@ -272,6 +294,22 @@ func (s *Server) updateRefreshToken(token *internal.RefreshToken, refresh *stora
 		return nil, rerr
 	}
 
+	// Rotation invalidates refresh.Token just as surely as an explicit
+	// revocation does: a resource server that cached an introspection
+	// result for it needs to be told the same way. rotated is only true
+	// when the updater actually advanced the stored token; the
+	// reuse-retry path above returns old unchanged and must not be
+	// reported as a rotation.
+	if rotated {
+		s.notifyRevocationHooks(RevocationEvent{
+			ClientID:  refresh.ClientID,
+			RefreshID: refresh.ID,
+			UserID:    refresh.Claims.UserID,
+			Reason:    RevocationReasonRotated,
+			At:        lastUsed,
+		})
+	}
+
 	return newToken, nil
 }
 
@@ -284,24 +322,56 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 		return
 	}
 
-	refresh, rerr := s.getRefreshTokenFromStorage(client.ID, token)
+	refresh, rerr := s.getRefreshTokenFromStorage(r, client.ID, token)
 	if rerr != nil {
 		s.refreshTokenErrHelper(w, rerr)
 		return
 	}
 
+	if s.enforceStepUp(w, r, refresh) {
+		return
+	}
+
 	scopes, rerr := s.getRefreshScopes(r, refresh)
 	if rerr != nil {
 		s.refreshTokenErrHelper(w, rerr)
 		return
 	}
 
+	resources, rerr := s.getRequestedResources(r, refresh)
+	if rerr != nil {
+		s.refreshTokenErrHelper(w, rerr)
+		return
+	}
+
 	ident, rerr := s.refreshWithConnector(r.Context(), token, refresh, scopes)
 	if rerr != nil {
 		s.refreshTokenErrHelper(w, rerr)
 		return
 	}
 
+	// Let operators prune scopes based on what the connector says about
+	// the user right now (e.g. group membership), rather than only at the
+	// original authorization.
+	scopes = s.downscopeRefresh(r.Context(), ident, scopes)
+
+	// If this refresh token was bound to a DPoP key at issuance (RFC 9449),
+	// the client must prove possession of that key again on every refresh.
+	// This is what makes the refresh token sender-constrained: a stolen
+	// token is useless without the private key that never leaves the
+	// client.
+	if refresh.JKT != "" {
+		jkt, rerr := s.verifyDPoPProof(r, s.tokenEndpointURL(r))
+		if rerr != nil {
+			s.refreshTokenErrHelper(w, rerr)
+			return
+		}
+		if jkt != refresh.JKT {
+			s.refreshTokenErrHelper(w, newBadRequestError("DPoP proof key does not match the key this refresh token is bound to."))
+			return
+		}
+	}
+
 	/*
 	 * Giant Swarm custom code to inject connector prefix in the group names, so it enables us
 	 * to use dex in shared installations
@@ -324,21 +394,31 @@ func (s *Server) handleRefreshToken(w http.ResponseWriter, r *http.Request, clie
 		Groups:            ident.Groups,
 	}
 
-	accessToken, err := s.newAccessToken(client.ID, claims, scopes, refresh.Nonce, refresh.ConnectorID)
+	// Binding the access token to the same key via a "cnf" claim (RFC 9449
+	// section 5) lets resource servers enforce DPoP on access tokens too,
+	// not just at dex's own token endpoint. resources restricts "aud" to
+	// whatever subset of the originally authorized resource indicators
+	// (RFC 8707) the client asked for on this refresh.
+	accessToken, err := s.newAccessToken(client.ID, claims, scopes, refresh.Nonce, refresh.ConnectorID, refresh.JKT, resources)
 	if err != nil {
 		s.logger.Errorf("failed to create new access token: %v", err)
 		s.refreshTokenErrHelper(w, newInternalServerError())
 		return
 	}
 
-	idToken, expiry, err := s.newIDToken(client.ID, claims, scopes, refresh.Nonce, accessToken, "", refresh.ConnectorID)
+	// refresh.ACR/AMR/AuthTime carry the strength of the original
+	// authentication event forward into every ID token minted from this
+	// refresh token, so step-up checks on the next refresh (and any
+	// resource server inspecting the ID token) see the same values the
+	// user actually authenticated with.
+	idToken, expiry, err := s.newIDToken(client.ID, claims, scopes, refresh.Nonce, accessToken, "", refresh.ConnectorID, refresh.ACR, refresh.AMR, refresh.AuthTime)
 	if err != nil {
 		s.logger.Errorf("failed to create ID token: %v", err)
 		s.refreshTokenErrHelper(w, newInternalServerError())
 		return
 	}
 
-	newToken, rerr := s.updateRefreshToken(token, refresh, ident)
+	newToken, rerr := s.updateRefreshToken(token, refresh, ident, resources)
 	if rerr != nil {
 		s.refreshTokenErrHelper(w, rerr)
 		return
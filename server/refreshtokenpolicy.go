@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RefreshTokenPolicy holds the rules the server applies when a refresh
+// token is presented at the token endpoint: whether rotation is enabled,
+// how long a token is valid for, and how long a just-rotated (obsolete)
+// token may still be exchanged for.
+type RefreshTokenPolicy struct {
+	rotateRefreshTokens bool
+
+	absoluteLifetime  time.Duration
+	validIfNotUsedFor time.Duration
+	reuseInterval     time.Duration
+
+	// allowStepUpRefresh controls whether a refresh request may demand a
+	// stronger acr_values or a fresher max_age than the token was issued
+	// under. When false, acr_values and max_age are ignored on refresh,
+	// matching dex's pre-existing behavior.
+	allowStepUpRefresh bool
+
+	// enableRiskSignals controls whether dex captures the issuing IP and
+	// User-Agent at issuance and compares them against every refresh.
+	// It's off by default: the signals are best-effort and can be wrong
+	// (an ISP or network change looks identical to token theft), so an
+	// operator has to opt into trading some false positives for the
+	// extra protection.
+	enableRiskSignals bool
+
+	now func() time.Time
+
+	logger logrus.FieldLogger
+}
+
+// NewRefreshTokenPolicy returns a RefreshTokenPolicy built from the
+// durations configured on the server, parsing each one and applying
+// sensible defaults when empty.
+func NewRefreshTokenPolicy(logger logrus.FieldLogger, rotation bool, validIfNotUsedFor, absoluteLifetime, reuseInterval string, allowStepUpRefresh, enableRiskSignals bool) (*RefreshTokenPolicy, error) {
+	p := &RefreshTokenPolicy{
+		rotateRefreshTokens: rotation,
+		allowStepUpRefresh:  allowStepUpRefresh,
+		enableRiskSignals:   enableRiskSignals,
+		now:                 time.Now,
+		logger:              logger,
+	}
+
+	for _, pair := range []struct {
+		name string
+		in   string
+		out  *time.Duration
+	}{
+		{"validIfNotUsedFor", validIfNotUsedFor, &p.validIfNotUsedFor},
+		{"absoluteLifetime", absoluteLifetime, &p.absoluteLifetime},
+		{"reuseInterval", reuseInterval, &p.reuseInterval},
+	} {
+		if pair.in == "" {
+			continue
+		}
+		d, err := time.ParseDuration(pair.in)
+		if err != nil {
+			return nil, fmt.Errorf("invalid refresh token policy duration %s=%q: %v", pair.name, pair.in, err)
+		}
+		*pair.out = d
+	}
+
+	return p, nil
+}
+
+// RotationEnabled reports whether refresh tokens are rotated on use.
+func (p *RefreshTokenPolicy) RotationEnabled() bool {
+	return p.rotateRefreshTokens
+}
+
+// AllowedToReuse reports whether a token that was last used at lastUsed
+// may still be exchanged again, to tolerate a client retrying a request
+// whose rotated response never arrived.
+func (p *RefreshTokenPolicy) AllowedToReuse(lastUsed time.Time) bool {
+	if p.reuseInterval == 0 {
+		return false
+	}
+	return p.now().Before(lastUsed.Add(p.reuseInterval))
+}
+
+// CompletelyExpired reports whether a token created at createdAt has
+// exceeded the policy's absolute lifetime.
+func (p *RefreshTokenPolicy) CompletelyExpired(createdAt time.Time) bool {
+	if p.absoluteLifetime == 0 {
+		return false
+	}
+	return p.now().After(createdAt.Add(p.absoluteLifetime))
+}
+
+// ExpiredBecauseUnused reports whether a token last used at lastUsed has
+// gone unused for longer than the policy allows.
+func (p *RefreshTokenPolicy) ExpiredBecauseUnused(lastUsed time.Time) bool {
+	if p.validIfNotUsedFor == 0 {
+		return false
+	}
+	return p.now().After(lastUsed.Add(p.validIfNotUsedFor))
+}
+
+// StepUpRefreshAllowed reports whether acr_values and max_age are
+// enforced on refresh requests.
+func (p *RefreshTokenPolicy) StepUpRefreshAllowed() bool {
+	return p.allowStepUpRefresh
+}
+
+// RiskSignalsEnabled reports whether dex should capture IP/User-Agent
+// signals at issuance and use them to flag anomalous refreshes.
+func (p *RefreshTokenPolicy) RiskSignalsEnabled() bool {
+	return p.enableRiskSignals
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/storage"
+)
+
+// getRequestedResources determines which RFC 8707 resource indicators the
+// access token minted from this refresh should be restricted to. A client
+// narrows the audience on a single refresh by repeating the "resource"
+// parameter; omitting it keeps the full set the refresh token was
+// originally authorized for. Requesting a resource outside that original
+// set is an error: resource indicators can only narrow, never widen, a
+// refresh token's audience.
+func (s *Server) getRequestedResources(r *http.Request, refresh *storage.RefreshToken) ([]string, *refreshError) {
+	requested := r.PostForm["resource"]
+	if len(requested) == 0 {
+		return refresh.Resources, nil
+	}
+
+	var unauthorized []string
+	for _, res := range requested {
+		if !contains(refresh.Resources, res) {
+			unauthorized = append(unauthorized, res)
+		}
+	}
+	if len(unauthorized) > 0 {
+		desc := fmt.Sprintf("Requested resource(s) were not authorized for this refresh token: %q.", unauthorized)
+		return nil, newBadRequestError(desc)
+	}
+
+	return requested, nil
+}
+
+// ScopeDownscoper lets operators prune the scopes a refresh is allowed to
+// carry forward, based on the connector identity returned for that
+// refresh. This is how an operator revokes a single privilege (say, a
+// scope gated on group membership) without waiting for the whole refresh
+// token to expire: the next refresh simply comes back with less.
+type ScopeDownscoper interface {
+	// DownscopeRefresh returns the subset of scopes that should survive
+	// this refresh. Implementations should only remove scopes, never add
+	// ones the client didn't already have.
+	DownscopeRefresh(ctx context.Context, ident connector.Identity, scopes []string) []string
+}
+
+// downscopeRefresh applies the server's configured ScopeDownscoper, if
+// any, to the scopes about to be granted on a refresh.
+func (s *Server) downscopeRefresh(ctx context.Context, ident connector.Identity, scopes []string) []string {
+	if s.scopeDownscoper == nil {
+		return scopes
+	}
+	return s.scopeDownscoper.DownscopeRefresh(ctx, ident, scopes)
+}
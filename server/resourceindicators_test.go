@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/connector"
+	"github.com/dexidp/dex/storage"
+	"github.com/dexidp/dex/storage/memory"
+)
+
+func TestGetRequestedResourcesPersistedAtIssuance(t *testing.T) {
+	s, store := newTestServer(t, testServerOptions{})
+
+	authorized := []string{"https://api.example.com", "https://other.example.com"}
+	_, refreshID := issueRefreshToken(t, s, store, authCodeOptions{resources: authorized})
+
+	refresh, err := store.GetRefresh(refreshID)
+	if err != nil {
+		t.Fatalf("get refresh: %v", err)
+	}
+	if !equalStrings(refresh.Resources, authorized) {
+		t.Fatalf("refresh.Resources = %v, want %v", refresh.Resources, authorized)
+	}
+}
+
+func TestGetRequestedResourcesRejectsUnauthorizedResource(t *testing.T) {
+	s, err := NewServer(Config{Issuer: "https://dex.example.com", Storage: memory.New(), Logger: logrus.New()})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	refresh := &storage.RefreshToken{Resources: []string{"https://api.example.com"}}
+	req := httptest.NewRequest(http.MethodPost, "https://dex.example.com/token", strings.NewReader("resource=https%3A%2F%2Fother.example.com"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := req.ParseForm(); err != nil {
+		t.Fatalf("parse form: %v", err)
+	}
+
+	if _, rerr := s.getRequestedResources(req, refresh); rerr == nil {
+		t.Fatal("requesting a resource outside the authorized set should be rejected")
+	}
+}
+
+// removingScopeDownscoper is a ScopeDownscoper test double that drops a
+// single fixed scope from whatever it's asked to downscope.
+type removingScopeDownscoper struct {
+	remove string
+}
+
+func (d removingScopeDownscoper) DownscopeRefresh(_ context.Context, _ connector.Identity, scopes []string) []string {
+	var kept []string
+	for _, scope := range scopes {
+		if scope != d.remove {
+			kept = append(kept, scope)
+		}
+	}
+	return kept
+}
+
+func TestDownscopeRefreshAppliesConfiguredDownscoper(t *testing.T) {
+	s, err := NewServer(Config{
+		Issuer:          "https://dex.example.com",
+		Storage:         memory.New(),
+		Logger:          logrus.New(),
+		ScopeDownscoper: removingScopeDownscoper{remove: "groups"},
+	})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	got := s.downscopeRefresh(context.Background(), connector.Identity{UserID: "user-1"}, []string{"openid", "groups"})
+	if !equalStrings(got, []string{"openid"}) {
+		t.Fatalf("downscopeRefresh() = %v, want [openid]", got)
+	}
+}
+
+func TestDownscopeRefreshIsNoopWithoutConfiguredDownscoper(t *testing.T) {
+	s, err := NewServer(Config{Issuer: "https://dex.example.com", Storage: memory.New(), Logger: logrus.New()})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	scopes := []string{"openid", "groups"}
+	got := s.downscopeRefresh(context.Background(), connector.Identity{UserID: "user-1"}, scopes)
+	if !equalStrings(got, scopes) {
+		t.Fatalf("downscopeRefresh() = %v, want %v unchanged", got, scopes)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
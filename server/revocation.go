@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/dexidp/dex/server/internal"
+	"github.com/dexidp/dex/storage"
+)
+
+// revocationPath is where dex serves the RFC 7009 token revocation
+// endpoint. It is registered alongside the other token endpoints in the
+// server's router setup.
+const revocationPath = "/token/revoke"
+
+// RevocationReason distinguishes a rotation, where the old token value
+// stops working but the refresh token itself is still alive, from an
+// actual revocation, where nothing about the refresh token works anymore.
+type RevocationReason string
+
+const (
+	RevocationReasonRotated RevocationReason = "rotated"
+	RevocationReasonRevoked RevocationReason = "revoked"
+)
+
+// RevocationEvent describes a refresh token rotation or revocation, for
+// delivery to registered RevocationHooks.
+type RevocationEvent struct {
+	ClientID  string
+	RefreshID string
+	UserID    string
+	Reason    RevocationReason
+	At        time.Time
+}
+
+// RevocationHook is notified whenever a refresh token is rotated or
+// revoked, so that subscribers (a webhook, a NATS or Kafka publisher, ...)
+// can tell downstream resource servers to drop any cached introspection
+// result for that token right away, instead of waiting out its TTL.
+type RevocationHook interface {
+	// Name identifies the hook in logs and error messages.
+	Name() string
+	// Notify delivers a single event. It's called with a background
+	// context and dex's own retry/backoff around it, so implementations
+	// don't need their own retry loop.
+	Notify(ctx context.Context, event RevocationEvent) error
+}
+
+// RevocationHookConfig controls how hard dex retries a RevocationHook
+// before giving up and just logging the failure.
+type RevocationHookConfig struct {
+	MaxRetries int
+	Backoff    time.Duration
+}
+
+// DefaultRevocationHookConfig is used when the server config doesn't
+// specify retry/backoff settings for revocation hooks.
+var DefaultRevocationHookConfig = RevocationHookConfig{
+	MaxRetries: 3,
+	Backoff:    time.Second,
+}
+
+// notifyRevocationHooks fans a RevocationEvent out to every registered
+// hook. Hooks run independently of the request that triggered the event
+// and of each other: one slow or failing hook can't hold up the others or
+// the HTTP response that's already been written.
+func (s *Server) notifyRevocationHooks(event RevocationEvent) {
+	for _, hook := range s.revocationHooks {
+		hook := hook
+		go func() {
+			cfg := s.revocationHookConfig
+			var err error
+			for attempt := 0; attempt <= cfg.MaxRetries; attempt++ {
+				if err = hook.Notify(context.Background(), event); err == nil {
+					return
+				}
+				if attempt < cfg.MaxRetries {
+					time.Sleep(cfg.Backoff * time.Duration(1<<attempt))
+				}
+			}
+			s.logger.Errorf("revocation hook %q failed after %d attempts: %v", hook.Name(), cfg.MaxRetries+1, err)
+		}()
+	}
+}
+
+// handleRevokeToken implements the OAuth 2.0 Token Revocation endpoint,
+// RFC 7009, for refresh tokens. Dex doesn't persist opaque access tokens
+// server-side, so an "access_token" hint is accepted but is always a
+// successful no-op, per the RFC's guidance that unknown or already-invalid
+// tokens must not produce an error response.
+func (s *Server) handleRevokeToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.tokenErrHelper(w, errInvalidRequest, "Failed to parse request body.", http.StatusBadRequest)
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostFormValue("client_id")
+		clientSecret = r.PostFormValue("client_secret")
+	}
+	client, err := s.storage.GetClient(clientID)
+	if err != nil || client.Secret != clientSecret {
+		s.tokenErrHelper(w, errInvalidClient, "Invalid client credentials.", http.StatusUnauthorized)
+		return
+	}
+
+	rawToken := r.PostFormValue("token")
+	if rawToken == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.PostFormValue("token_type_hint") == "access_token" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	token := new(internal.RefreshToken)
+	if err := internal.Unmarshal(rawToken, token); err != nil {
+		token = &internal.RefreshToken{RefreshId: rawToken}
+	}
+
+	refresh, err := s.storage.GetRefresh(token.RefreshId)
+	switch {
+	case err == storage.ErrNotFound:
+		// Per RFC 7009 section 2.2, revoking an invalid or already-revoked
+		// token is not an error.
+		w.WriteHeader(http.StatusOK)
+		return
+	case err != nil:
+		s.logger.Errorf("failed to get refresh token %s for revocation: %v", token.RefreshId, err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	if refresh.ClientID != client.ID {
+		s.tokenErrHelper(w, errInvalidClient, "Token was not issued to this client.", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.storage.DeleteRefresh(refresh.ID); err != nil && err != storage.ErrNotFound {
+		s.logger.Errorf("failed to delete refresh token %s during revocation: %v", refresh.ID, err)
+		s.tokenErrHelper(w, errServerError, "", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.storage.DeleteOfflineSessions(refresh.Claims.UserID, refresh.ConnectorID); err != nil && err != storage.ErrNotFound {
+		s.logger.Errorf("failed to delete offline session for %s during revocation: %v", refresh.Claims.UserID, err)
+	}
+
+	s.notifyRevocationHooks(RevocationEvent{
+		ClientID:  refresh.ClientID,
+		RefreshID: refresh.ID,
+		UserID:    refresh.Claims.UserID,
+		Reason:    RevocationReasonRevoked,
+		At:        s.now(),
+	})
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/storage"
+	"github.com/dexidp/dex/storage/memory"
+)
+
+// recordingRevocationHook is a RevocationHook test double that captures
+// every event it's notified of on a channel.
+type recordingRevocationHook struct {
+	events chan RevocationEvent
+}
+
+func (h *recordingRevocationHook) Name() string { return "recording" }
+
+func (h *recordingRevocationHook) Notify(_ context.Context, event RevocationEvent) error {
+	h.events <- event
+	return nil
+}
+
+func TestRevokeTokenDeletesRefreshToken(t *testing.T) {
+	hook := &recordingRevocationHook{events: make(chan RevocationEvent, 1)}
+
+	s, store := newTestServer(t, testServerOptions{
+		revocationHooks:      []RevocationHook{hook},
+		revocationHookConfig: RevocationHookConfig{MaxRetries: 0, Backoff: time.Millisecond},
+	})
+
+	rawRefreshToken, _ := issueRefreshToken(t, s, store, authCodeOptions{})
+
+	tokenURL := "https://dex.example.com/token"
+	mux := s.Handler()
+	revokeForm := url.Values{"token": {rawRefreshToken}}
+	revokeReq := httptest.NewRequest(http.MethodPost, "https://dex.example.com"+revocationPath, strings.NewReader(revokeForm.Encode()))
+	revokeReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	revokeReq.SetBasicAuth("test-client", "test-secret")
+
+	revokeRec := httptest.NewRecorder()
+	mux.ServeHTTP(revokeRec, revokeReq)
+	if revokeRec.Code != http.StatusOK {
+		t.Fatalf("revoke request failed: %d %s", revokeRec.Code, revokeRec.Body.String())
+	}
+
+	select {
+	case event := <-hook.events:
+		if event.Reason != RevocationReasonRevoked {
+			t.Fatalf("event.Reason = %q, want %q", event.Reason, RevocationReasonRevoked)
+		}
+		if event.ClientID != "test-client" {
+			t.Fatalf("event.ClientID = %q, want %q", event.ClientID, "test-client")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("revocation hook was never notified")
+	}
+
+	refreshForm := url.Values{"grant_type": {grantTypeRefreshToken}, "refresh_token": {rawRefreshToken}}
+	refreshReq := httptest.NewRequest(http.MethodPost, tokenURL, strings.NewReader(refreshForm.Encode()))
+	refreshReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	refreshReq.SetBasicAuth("test-client", "test-secret")
+
+	refreshRec := httptest.NewRecorder()
+	s.handleToken(refreshRec, refreshReq)
+	if refreshRec.Code == http.StatusOK {
+		t.Fatal("refreshing a revoked token should fail")
+	}
+}
+
+func TestRotatedHookNotFiredOnReuseRetry(t *testing.T) {
+	hook := &recordingRevocationHook{events: make(chan RevocationEvent, 4)}
+
+	s, store := newTestServer(t, testServerOptions{
+		rotation:             true,
+		reuseInterval:        "1m",
+		revocationHooks:      []RevocationHook{hook},
+		revocationHookConfig: RevocationHookConfig{MaxRetries: 0, Backoff: time.Millisecond},
+	})
+
+	rawRefreshToken, _ := issueRefreshToken(t, s, store, authCodeOptions{})
+
+	tokenURL := "https://dex.example.com/token"
+	refresh := func(rawToken string) accessTokenResponse {
+		t.Helper()
+		form := url.Values{"grant_type": {grantTypeRefreshToken}, "refresh_token": {rawToken}}
+		req := httptest.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth("test-client", "test-secret")
+		rec := httptest.NewRecorder()
+		s.handleToken(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("refresh failed: %d %s", rec.Code, rec.Body.String())
+		}
+		var resp accessTokenResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode refresh response: %v", err)
+		}
+		return resp
+	}
+
+	// First refresh genuinely rotates the token: expect exactly one
+	// "rotated" hook notification.
+	refresh(rawRefreshToken)
+
+	select {
+	case event := <-hook.events:
+		if event.Reason != RevocationReasonRotated {
+			t.Fatalf("event.Reason = %q, want %q", event.Reason, RevocationReasonRotated)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected a rotated hook notification for the genuine rotation")
+	}
+
+	// Retrying with the now-obsolete original token, inside the reuse
+	// window, must succeed (the client may simply never have seen the
+	// rotated response) but must NOT fire another rotated hook: nothing
+	// about the stored token actually changed.
+	refresh(rawRefreshToken)
+
+	select {
+	case event := <-hook.events:
+		t.Fatalf("reuse-retry should not fire a revocation hook, got %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRevokeTokenIsIdempotentForUnknownToken(t *testing.T) {
+	store := memory.New()
+	if err := store.CreateClient(storage.Client{ID: "test-client", Secret: "test-secret"}); err != nil {
+		t.Fatalf("create client: %v", err)
+	}
+
+	s, err := NewServer(Config{Issuer: "https://dex.example.com", Storage: store, Logger: logrus.New()})
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	form := url.Values{"token": {"not-a-real-token"}}
+	req := httptest.NewRequest(http.MethodPost, "https://dex.example.com"+revocationPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("test-client", "test-secret")
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("revoking an unknown token should succeed per RFC 7009, got %d %s", rec.Code, rec.Body.String())
+	}
+}
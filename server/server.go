@@ -0,0 +1,136 @@
+package server
+
+import (
+	"crypto/rand"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// accessTokenLifetime and idTokenLifetime bound how long the tokens
+// minted by the token endpoint are valid for.
+const (
+	accessTokenLifetime = time.Hour
+	idTokenLifetime     = time.Hour
+)
+
+// Config holds everything needed to construct a Server.
+type Config struct {
+	Issuer string
+
+	Storage storage.Storage
+	Logger  logrus.FieldLogger
+
+	RefreshTokenPolicy *RefreshTokenPolicy
+
+	OIDCGroupsPrefix bool
+
+	// RevocationHooks are notified whenever a refresh token is rotated or
+	// revoked. RevocationHookConfig controls how hard each one is
+	// retried before dex gives up and just logs the failure.
+	RevocationHooks      []RevocationHook
+	RevocationHookConfig RevocationHookConfig
+
+	// ScopeDownscoper, if set, lets an operator prune the scopes a
+	// refresh carries forward based on the connector identity it
+	// resolves to. Leave nil to carry every scope forward unchanged.
+	ScopeDownscoper ScopeDownscoper
+
+	// RiskSignalSource customizes the signals captured at issuance and
+	// compared on refresh when the refresh token policy has risk signals
+	// enabled. Leave nil to use the default IP/User-Agent pair.
+	RiskSignalSource RiskSignalSource
+
+	// Now is used in place of time.Now for testing.
+	Now func() time.Time
+}
+
+// Server serves dex's token endpoint and its refresh/DPoP/revocation
+// extensions.
+type Server struct {
+	issuerURL string
+
+	storage storage.Storage
+	logger  logrus.FieldLogger
+
+	now func() time.Time
+
+	refreshTokenPolicy *RefreshTokenPolicy
+
+	// oidcGroupsPrefix, when set, namespaces group names with the
+	// connector ID so the same group name from different connectors
+	// doesn't collide in a shared installation.
+	oidcGroupsPrefix bool
+
+	revocationHooks      []RevocationHook
+	revocationHookConfig RevocationHookConfig
+
+	scopeDownscoper  ScopeDownscoper
+	riskSignalSource RiskSignalSource
+
+	// signingKey signs access and ID tokens. A single symmetric key is
+	// enough for dex's own token endpoint to verify tokens it minted
+	// itself; resource servers are expected to use introspection rather
+	// than verifying dex's tokens directly.
+	signingKey []byte
+}
+
+// NewServer constructs a Server from c, filling in defaults for anything
+// left unset.
+func NewServer(c Config) (*Server, error) {
+	now := c.Now
+	if now == nil {
+		now = time.Now
+	}
+
+	refreshTokenPolicy := c.RefreshTokenPolicy
+	if refreshTokenPolicy == nil {
+		p, err := NewRefreshTokenPolicy(c.Logger, false, "", "", "", false, false)
+		if err != nil {
+			return nil, err
+		}
+		refreshTokenPolicy = p
+	}
+
+	revocationHookConfig := c.RevocationHookConfig
+	if revocationHookConfig == (RevocationHookConfig{}) {
+		revocationHookConfig = DefaultRevocationHookConfig
+	}
+
+	riskSignalSource := c.RiskSignalSource
+	if riskSignalSource == nil {
+		riskSignalSource = defaultRiskSignalSource{}
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		issuerURL:            c.Issuer,
+		storage:              c.Storage,
+		logger:               c.Logger,
+		now:                  now,
+		refreshTokenPolicy:   refreshTokenPolicy,
+		oidcGroupsPrefix:     c.OIDCGroupsPrefix,
+		revocationHooks:      c.RevocationHooks,
+		revocationHookConfig: revocationHookConfig,
+		scopeDownscoper:      c.ScopeDownscoper,
+		riskSignalSource:     riskSignalSource,
+		signingKey:           key,
+	}, nil
+}
+
+// Handler returns the http.Handler serving the token endpoint family:
+// the main token endpoint (authorization_code and refresh_token grants)
+// and the RFC 7009 revocation endpoint.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", s.handleToken)
+	mux.HandleFunc(revocationPath, s.handleRevokeToken)
+	return mux
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// errInsufficientUserAuthentication is the error code returned when a
+// refresh can't satisfy the authentication strength a client asked for via
+// acr_values or max_age, per the OAuth 2.0 Step Up Authentication
+// Challenge Protocol.
+const errInsufficientUserAuthentication = "insufficient_user_authentication"
+
+// stepUpHint carries the acr_values and/or max_age a client should take
+// the user through a fresh authorization request with.
+type stepUpHint struct {
+	ACRValues string
+	MaxAge    string
+}
+
+// stepUpErrHelper writes an insufficient_user_authentication error
+// response, including the acr_values / max_age the client requested so it
+// knows what to ask for on the subsequent authorization request.
+func (s *Server) stepUpErrHelper(w http.ResponseWriter, desc string, hint stepUpHint) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(struct {
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description,omitempty"`
+		ACRValues        string `json:"acr_values,omitempty"`
+		MaxAge           string `json:"max_age,omitempty"`
+	}{
+		Error:            errInsufficientUserAuthentication,
+		ErrorDescription: desc,
+		ACRValues:        hint.ACRValues,
+		MaxAge:           hint.MaxAge,
+	})
+}
+
+// acrSufficient reports whether have satisfies the strength requested by
+// want. Dex treats acr_values as a set of acceptable values: have is
+// sufficient if it's one of them, or if the client didn't request a
+// particular value at all.
+func acrSufficient(want []string, have string) bool {
+	if len(want) == 0 {
+		return true
+	}
+	return contains(want, have)
+}
+
+// enforceStepUp checks a refresh request's acr_values and max_age against
+// the authentication event recorded on refresh, writing an
+// insufficient_user_authentication response and returning true if the
+// client needs to take the user through a fresh, stronger authorization
+// request before refreshing can proceed.
+func (s *Server) enforceStepUp(w http.ResponseWriter, r *http.Request, refresh *storage.RefreshToken) bool {
+	if !s.refreshTokenPolicy.StepUpRefreshAllowed() {
+		return false
+	}
+
+	if acrValues := r.PostFormValue("acr_values"); acrValues != "" {
+		if !acrSufficient(strings.Fields(acrValues), refresh.ACR) {
+			s.stepUpErrHelper(w, "The requested acr_values exceed the authentication strength this refresh token was issued under.", stepUpHint{ACRValues: acrValues})
+			return true
+		}
+	}
+
+	if maxAge := r.PostFormValue("max_age"); maxAge != "" {
+		seconds, err := strconv.Atoi(maxAge)
+		if err != nil || seconds < 0 {
+			s.stepUpErrHelper(w, "max_age must be a non-negative integer.", stepUpHint{MaxAge: maxAge})
+			return true
+		}
+		if s.now().After(refresh.AuthTime.Add(time.Duration(seconds) * time.Second)) {
+			s.stepUpErrHelper(w, "The user's original authentication is older than the requested max_age.", stepUpHint{MaxAge: maxAge})
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dexidp/dex/storage/memory"
+)
+
+func issueRefreshTokenWithAuthEvent(t *testing.T, s *Server, store *memory.Storage, acr string, authTime time.Time) string {
+	t.Helper()
+
+	rawRefreshToken, _ := issueRefreshToken(t, s, store, authCodeOptions{acr: acr, amr: []string{"pwd"}, authTime: authTime})
+	return rawRefreshToken
+}
+
+func refreshWithStepUp(s *Server, refreshToken, acrValues, maxAge string) *httptest.ResponseRecorder {
+	form := url.Values{"grant_type": {grantTypeRefreshToken}, "refresh_token": {refreshToken}}
+	if acrValues != "" {
+		form.Set("acr_values", acrValues)
+	}
+	if maxAge != "" {
+		form.Set("max_age", maxAge)
+	}
+	req := httptest.NewRequest(http.MethodPost, "https://dex.example.com/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("test-client", "test-secret")
+
+	rec := httptest.NewRecorder()
+	s.handleToken(rec, req)
+	return rec
+}
+
+func TestStepUpRefreshHonorsPersistedACR(t *testing.T) {
+	s, store := newTestServer(t, testServerOptions{allowStepUpRefresh: true})
+	refreshToken := issueRefreshTokenWithAuthEvent(t, s, store, "urn:mace:incommon:iap:silver", time.Now())
+
+	if rec := refreshWithStepUp(s, refreshToken, "urn:mace:incommon:iap:gold", ""); rec.Code == http.StatusOK {
+		t.Fatalf("refresh requesting a stronger acr than was recorded should be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rec := refreshWithStepUp(s, refreshToken, "urn:mace:incommon:iap:silver", ""); rec.Code != http.StatusOK {
+		t.Fatalf("refresh requesting the recorded acr should succeed, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStepUpRefreshHonorsPersistedAuthTime(t *testing.T) {
+	s, store := newTestServer(t, testServerOptions{allowStepUpRefresh: true})
+	refreshToken := issueRefreshTokenWithAuthEvent(t, s, store, "", time.Now())
+
+	if rec := refreshWithStepUp(s, refreshToken, "", "3600"); rec.Code != http.StatusOK {
+		t.Fatalf("refresh requesting a max_age newer than the recorded auth_time should succeed, got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStepUpRefreshRejectsStaleAuthTime(t *testing.T) {
+	s, store := newTestServer(t, testServerOptions{allowStepUpRefresh: true})
+	refreshToken := issueRefreshTokenWithAuthEvent(t, s, store, "", time.Now().Add(-time.Hour))
+
+	if rec := refreshWithStepUp(s, refreshToken, "", "60"); rec.Code == http.StatusOK {
+		t.Fatalf("refresh requesting a max_age older than the recorded auth_time should be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+}
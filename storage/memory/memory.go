@@ -0,0 +1,178 @@
+// Package memory provides an in-memory storage.Storage implementation.
+// It's meant for tests, not for production use: nothing is persisted
+// across process restarts and nothing is garbage collected.
+package memory
+
+import (
+	"sync"
+
+	"github.com/dexidp/dex/storage"
+)
+
+// Storage is an in-memory storage.Storage.
+type Storage struct {
+	mu sync.Mutex
+
+	clients   map[string]storage.Client
+	authCodes map[string]storage.AuthCode
+	refresh   map[string]storage.RefreshToken
+	sessions  map[string]storage.OfflineSessions
+}
+
+// New returns an empty in-memory Storage.
+func New() *Storage {
+	return &Storage{
+		clients:   make(map[string]storage.Client),
+		authCodes: make(map[string]storage.AuthCode),
+		refresh:   make(map[string]storage.RefreshToken),
+		sessions:  make(map[string]storage.OfflineSessions),
+	}
+}
+
+func sessionKey(userID, connID string) string {
+	return userID + "|" + connID
+}
+
+func (s *Storage) CreateClient(c storage.Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c.ID] = c
+	return nil
+}
+
+func (s *Storage) GetClient(id string) (storage.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.clients[id]
+	if !ok {
+		return storage.Client{}, storage.ErrNotFound
+	}
+	return c, nil
+}
+
+func (s *Storage) CreateAuthCode(a storage.AuthCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authCodes[a.ID] = a
+	return nil
+}
+
+func (s *Storage) GetAuthCode(id string) (storage.AuthCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.authCodes[id]
+	if !ok {
+		return storage.AuthCode{}, storage.ErrNotFound
+	}
+	return a, nil
+}
+
+func (s *Storage) DeleteAuthCode(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.authCodes[id]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(s.authCodes, id)
+	return nil
+}
+
+func (s *Storage) CreateRefresh(r storage.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refresh[r.ID] = r
+	return nil
+}
+
+func (s *Storage) GetRefresh(id string) (storage.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.refresh[id]
+	if !ok {
+		return storage.RefreshToken{}, storage.ErrNotFound
+	}
+	return r, nil
+}
+
+func (s *Storage) UpdateRefreshToken(id string, updater func(old storage.RefreshToken) (storage.RefreshToken, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.refresh[id]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	updated, err := updater(old)
+	if err != nil {
+		return err
+	}
+	s.refresh[id] = updated
+	return nil
+}
+
+func (s *Storage) DeleteRefresh(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.refresh[id]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(s.refresh, id)
+	return nil
+}
+
+// ListFamily implements server.FamilyStore, returning every refresh
+// token ID that shares familyID.
+func (s *Storage) ListFamily(familyID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for id, r := range s.refresh {
+		if r.FamilyID == familyID {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (s *Storage) CreateOfflineSessions(o storage.OfflineSessions) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sessionKey(o.UserID, o.ConnID)] = o
+	return nil
+}
+
+func (s *Storage) GetOfflineSessions(userID, connID string) (storage.OfflineSessions, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.sessions[sessionKey(userID, connID)]
+	if !ok {
+		return storage.OfflineSessions{}, storage.ErrNotFound
+	}
+	return o, nil
+}
+
+func (s *Storage) UpdateOfflineSessions(userID, connID string, updater func(old storage.OfflineSessions) (storage.OfflineSessions, error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := sessionKey(userID, connID)
+	old, ok := s.sessions[key]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	updated, err := updater(old)
+	if err != nil {
+		return err
+	}
+	s.sessions[key] = updated
+	return nil
+}
+
+func (s *Storage) DeleteOfflineSessions(userID, connID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := sessionKey(userID, connID)
+	if _, ok := s.sessions[key]; !ok {
+		return storage.ErrNotFound
+	}
+	delete(s.sessions, key)
+	return nil
+}
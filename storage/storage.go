@@ -0,0 +1,186 @@
+// Package storage defines the interfaces used to persist dex's state
+// (clients, auth requests, refresh tokens, offline sessions, etc).
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by storage implementations when a resource
+// cannot be located.
+var ErrNotFound = errors.New("not found")
+
+// ErrAlreadyExists is returned by storage implementations when a create
+// call collides with an existing resource.
+var ErrAlreadyExists = errors.New("already exists")
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewID returns a random string which can be used as an ID for storage
+// resources. IDs are not guaranteed to be globally unique, but collisions
+// are astronomically unlikely.
+func NewID() string {
+	buff := make([]byte, 16) // 128 bit random ID.
+	if _, err := io.ReadFull(rand.Reader, buff); err != nil {
+		panic(err)
+	}
+	return encoding.EncodeToString(buff)
+}
+
+// Claims is a mirror of the claims that end up in an ID token, persisted
+// alongside refresh tokens and offline sessions so dex can mint new ID
+// tokens without going back to the connector.
+type Claims struct {
+	UserID            string
+	Username          string
+	PreferredUsername string
+	Email             string
+	EmailVerified     bool
+	Groups            []string
+}
+
+// RefreshToken is a stored refresh token.
+type RefreshToken struct {
+	ID string
+
+	// Token is the most recently issued value for this refresh token ID.
+	// ObsoleteToken is the previous value, kept around briefly so that a
+	// client which never saw the rotated response (e.g. the response was
+	// lost in transit) can still retry within the refresh token policy's
+	// reuse interval.
+	Token         string
+	ObsoleteToken string
+
+	CreatedAt time.Time
+	LastUsed  time.Time
+
+	Claims Claims
+
+	ClientID string
+	Scopes   []string
+
+	Nonce string
+
+	ConnectorID   string
+	ConnectorData []byte
+
+	// JKT is the base64url-encoded SHA-256 JWK thumbprint of the DPoP
+	// key this refresh token is bound to, per RFC 9449. Empty if the
+	// token was issued without a DPoP proof, in which case it behaves
+	// as an ordinary bearer token.
+	JKT string
+
+	// ACR, AMR and AuthTime record the strength of the authentication
+	// event that originally produced this refresh token, so a later
+	// refresh request asking for a stronger acr_values or a recent
+	// max_age can be told it needs a fresh, stronger auth flow instead
+	// of silently being granted at the original strength.
+	ACR      string
+	AMR      []string
+	AuthTime time.Time
+
+	// Resources is the set of RFC 8707 resource indicators this refresh
+	// token was originally authorized for. A refresh request may narrow
+	// an access token's audience to any subset of these via the
+	// "resource" parameter, but never widen it.
+	Resources []string
+
+	// LastIssuedResources is the resource indicator subset the most
+	// recent successful refresh actually minted an access token for,
+	// kept purely so audit logs can show which audience was granted
+	// without needing to correlate against request logs. A retry with the
+	// obsolete token inside the reuse interval leaves it unchanged.
+	LastIssuedResources []string
+
+	// FamilyID groups a refresh token together with every token it was
+	// ever rotated into. Reuse of any one token in the family revokes
+	// them all, since reuse of an obsolete token is the clearest signal
+	// dex has that a refresh token was stolen.
+	FamilyID string
+
+	// IssuedIP and IssuedUserAgentHash are best-effort signals captured
+	// when this token (or the original token in its family) was first
+	// issued, compared against the current request on every refresh to
+	// compute a risk score. Empty if the deployment doesn't capture them.
+	IssuedIP            string
+	IssuedUserAgentHash string
+}
+
+// RefreshTokenRef is a reference to a RefreshToken stored on an
+// OfflineSessions object, keyed by client ID.
+type RefreshTokenRef struct {
+	ID        string
+	ClientID  string
+	CreatedAt time.Time
+	LastUsed  time.Time
+}
+
+// OfflineSessions represents a user's offline session, tracking the
+// connector data and the set of refresh tokens issued to clients on the
+// user's behalf.
+type OfflineSessions struct {
+	UserID        string
+	ConnID        string
+	Refresh       map[string]*RefreshTokenRef
+	ConnectorData []byte
+}
+
+// Storage is the interface dex uses to persist its state. Only the
+// subset of methods exercised by the refresh token flows is declared
+// here.
+type Storage interface {
+	CreateClient(c Client) error
+	GetClient(id string) (Client, error)
+
+	CreateAuthCode(a AuthCode) error
+	GetAuthCode(id string) (AuthCode, error)
+	DeleteAuthCode(id string) error
+
+	GetRefresh(id string) (RefreshToken, error)
+	CreateRefresh(r RefreshToken) error
+	UpdateRefreshToken(id string, updater func(old RefreshToken) (RefreshToken, error)) error
+	DeleteRefresh(id string) error
+
+	CreateOfflineSessions(o OfflineSessions) error
+	GetOfflineSessions(userID, connID string) (OfflineSessions, error)
+	UpdateOfflineSessions(userID, connID string, updater func(old OfflineSessions) (OfflineSessions, error)) error
+	DeleteOfflineSessions(userID, connID string) error
+}
+
+// Client is an OAuth2 client registered with dex.
+type Client struct {
+	ID     string
+	Secret string
+}
+
+// AuthCode is a short-lived authorization code handed to a client at the
+// end of the authorization request, to be exchanged at the token endpoint
+// for access, ID and (if requested) refresh tokens.
+type AuthCode struct {
+	ID string
+
+	ClientID string
+	Scopes   []string
+	Nonce    string
+
+	Claims      Claims
+	ConnectorID string
+
+	// ACR, AMR and AuthTime record the strength of the authentication
+	// event the connector reported when this code was issued, so it can
+	// be carried forward onto any refresh token minted from it.
+	ACR      string
+	AMR      []string
+	AuthTime time.Time
+
+	// Resources is the set of RFC 8707 resource indicators the
+	// authorization request was granted, carried forward onto any
+	// refresh token minted from this code.
+	Resources []string
+
+	Expiry time.Time
+}